@@ -0,0 +1,103 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// +build linux_bpf
+
+package probe
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// criContainerStatus is the subset of the CRI ContainerStatus response CRIResolver cares about.
+type criContainerStatus struct {
+	PodSandboxID string
+	Image        string
+	ImageRef     string
+	Labels       map[string]string
+	Annotations  map[string]string
+}
+
+// criPodSandboxStatus is the subset of the CRI PodSandboxStatus response CRIResolver cares about.
+type criPodSandboxStatus struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+// criGRPCConn is a thin wrapper around a generic CRI RuntimeService gRPC connection, used for runtimes (e.g.
+// CRI-O) that don't expose a containerd-compatible client.
+type criGRPCConn struct {
+	conn   *grpc.ClientConn
+	client runtimeapi.RuntimeServiceClient
+}
+
+func dialCRIGRPC(socket string) (*criGRPCConn, error) {
+	conn, err := grpc.Dial(
+		"unix://"+socket,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithTimeout(5*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &criGRPCConn{
+		conn:   conn,
+		client: runtimeapi.NewRuntimeServiceClient(conn),
+	}, nil
+}
+
+func (c *criGRPCConn) ContainerStatus(ctx context.Context, containerID string) (*criContainerStatus, error) {
+	statusResp, err := c.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{ContainerId: containerID})
+	if err != nil {
+		return nil, err
+	}
+	status := statusResp.GetStatus()
+
+	// the container's pod sandbox ID isn't part of ContainerStatus, it has to be looked up via ListContainers
+	listResp, err := c.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{Id: containerID},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var podSandboxID string
+	if containers := listResp.GetContainers(); len(containers) > 0 {
+		podSandboxID = containers[0].GetPodSandboxId()
+	}
+
+	return &criContainerStatus{
+		PodSandboxID: podSandboxID,
+		Image:        status.GetImage().GetImage(),
+		ImageRef:     status.GetImageRef(),
+		Labels:       status.GetLabels(),
+		Annotations:  status.GetAnnotations(),
+	}, nil
+}
+
+func (c *criGRPCConn) PodSandboxStatus(ctx context.Context, podSandboxID string) (*criPodSandboxStatus, error) {
+	resp, err := c.client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{PodSandboxId: podSandboxID})
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := resp.GetStatus().GetMetadata()
+	return &criPodSandboxStatus{
+		Namespace: metadata.GetNamespace(),
+		Name:      metadata.GetName(),
+		UID:       metadata.GetUid(),
+	}, nil
+}
+
+func (c *criGRPCConn) Close() error {
+	return c.conn.Close()
+}
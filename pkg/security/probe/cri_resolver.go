@@ -0,0 +1,271 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// +build linux_bpf
+
+package probe
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// criSockets is the ordered list of sockets the resolver probes to auto-detect the local container runtime.
+var criSockets = []struct {
+	path    string
+	backend string
+}{
+	{path: "/run/containerd/containerd.sock", backend: "containerd"},
+	{path: "/run/crio/crio.sock", backend: "cri"},
+}
+
+const (
+	// defaultCRICacheTTL bounds how long a resolved container's metadata is reused before being re-fetched from the
+	// runtime, so that label/annotation updates are eventually picked up without hitting the runtime on every
+	// process.
+	defaultCRICacheTTL = 5 * time.Minute
+
+	// defaultCRINegativeCacheTTL bounds how long a failed lookup (unknown container, runtime error or timeout) is
+	// cached before being retried. It's much shorter than defaultCRICacheTTL since the container may simply not
+	// exist yet, but it still keeps a confused or unresponsive runtime from being hit by every process snapshot.
+	defaultCRINegativeCacheTTL = 30 * time.Second
+)
+
+// CRIMetadata is the enriched, CRI-sourced metadata attached to a container once resolved.
+type CRIMetadata struct {
+	ImageName    string
+	ImageDigest  string
+	PodNamespace string
+	PodName      string
+	PodUID       string
+	Labels       map[string]string
+	Annotations  map[string]string
+}
+
+// criClient abstracts over the concrete runtime client (containerd, or a generic CRI gRPC client) so that
+// CRIResolver doesn't need to care which backend is in use.
+type criClient interface {
+	// ContainerMetadata fetches the metadata for a single container ID.
+	ContainerMetadata(ctx context.Context, containerID string) (*CRIMetadata, error)
+	Close() error
+}
+
+// criCacheEntry caches either a successful resolution (metadata set, err nil) or a failed one (metadata nil, err
+// set), so that an unresolved container doesn't force a fresh RPC against the runtime on every lookup.
+type criCacheEntry struct {
+	metadata  *CRIMetadata
+	err       error
+	expiresAt time.Time
+}
+
+// CRIResolver enriches container IDs resolved by ContainerResolver with image and pod metadata pulled from the
+// local container runtime over CRI. It is optional: if no supported runtime socket is found, Resolve always
+// returns an error and callers must keep using the cgroup-only container ID.
+type CRIResolver struct {
+	ttl time.Duration
+
+	clientMu sync.RWMutex
+	client   criClient
+
+	mu    sync.Mutex
+	cache map[string]*criCacheEntry
+}
+
+// NewCRIResolver returns a resolver that auto-detects the local container runtime socket in the background.
+// Detecting and dialing the socket can block for several seconds (e.g. the generic CRI client dials with
+// grpc.WithBlock()), so it must not run on the agent startup path: Resolve treats a not-yet-detected (or never
+// found) client the same way, as "CRI resolver disabled", since enrichment is optional and its absence must not
+// prevent the process resolver from starting.
+func NewCRIResolver() *CRIResolver {
+	r := &CRIResolver{
+		ttl:   defaultCRICacheTTL,
+		cache: make(map[string]*criCacheEntry),
+	}
+
+	go r.detectClient()
+
+	return r
+}
+
+// detectClient probes criSockets for a supported runtime and, once dialed, publishes the resulting client for
+// Resolve to pick up. Runs in its own goroutine; see NewCRIResolver.
+func (r *CRIResolver) detectClient() {
+	for _, candidate := range criSockets {
+		if _, err := os.Stat(candidate.path); err != nil {
+			continue
+		}
+
+		client, err := newCRIClient(candidate.backend, candidate.path)
+		if err != nil {
+			log.Debugf("couldn't create CRI client for %s: %v", candidate.path, err)
+			continue
+		}
+
+		r.clientMu.Lock()
+		r.client = client
+		r.clientMu.Unlock()
+		return
+	}
+
+	log.Debug("no supported CRI socket found, container metadata enrichment disabled")
+}
+
+func newCRIClient(backend, socket string) (criClient, error) {
+	switch backend {
+	case "containerd":
+		return newContainerdClient(socket)
+	case "cri":
+		return newGenericCRIClient(socket)
+	default:
+		return nil, errors.Errorf("unsupported CRI backend %q", backend)
+	}
+}
+
+// Resolve returns the cached or freshly fetched metadata for containerID. Callers must treat a non-nil error as
+// "fall back to cgroup-only behaviour": it is returned for a disabled resolver, a runtime-side failure, or an
+// unknown container, none of which are fatal to process resolution. A failed lookup is cached too (under
+// defaultCRINegativeCacheTTL) so that a container that doesn't resolve doesn't cost a fresh RPC on every call.
+func (r *CRIResolver) Resolve(containerID string) (*CRIMetadata, error) {
+	r.clientMu.RLock()
+	client := r.client
+	r.clientMu.RUnlock()
+
+	if client == nil || containerID == "" {
+		return nil, errors.New("CRI resolver disabled")
+	}
+
+	r.mu.Lock()
+	if entry, ok := r.cache[containerID]; ok && time.Now().Before(entry.expiresAt) {
+		r.mu.Unlock()
+		return entry.metadata, entry.err
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	metadata, err := client.ContainerMetadata(ctx, containerID)
+
+	entry := &criCacheEntry{metadata: metadata, expiresAt: time.Now().Add(r.ttl)}
+	if err != nil {
+		entry.err = errors.Wrapf(err, "couldn't fetch CRI metadata for container %s", containerID)
+		entry.expiresAt = time.Now().Add(defaultCRINegativeCacheTTL)
+	}
+
+	r.mu.Lock()
+	r.cache[containerID] = entry
+	r.mu.Unlock()
+
+	return entry.metadata, entry.err
+}
+
+// Close releases the underlying runtime client connection, if one was detected.
+func (r *CRIResolver) Close() error {
+	r.clientMu.RLock()
+	client := r.client
+	r.clientMu.RUnlock()
+
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+// containerdClient implements criClient on top of containerd's own client and its containers/images services.
+type containerdClient struct {
+	client *containerd.Client
+}
+
+func newContainerdClient(socket string) (criClient, error) {
+	client, err := containerd.New(socket)
+	if err != nil {
+		return nil, err
+	}
+	return &containerdClient{client: client}, nil
+}
+
+func (c *containerdClient) ContainerMetadata(ctx context.Context, containerID string) (*CRIMetadata, error) {
+	// containerd namespaces k8s containers under "k8s.io"
+	ctx = namespaces.WithNamespace(ctx, "k8s.io")
+
+	container, err := c.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := container.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// containerd's containers.Container.Info only carries Labels; OCI annotations live in the runtime spec, not
+	// here, so leave Annotations unset rather than aliasing it to the same map as Labels.
+	metadata := &CRIMetadata{
+		ImageName: info.Image,
+		Labels:    info.Labels,
+	}
+
+	if img, err := c.client.GetImage(ctx, info.Image); err == nil {
+		metadata.ImageDigest = img.Target().Digest.String()
+	}
+
+	metadata.PodNamespace = info.Labels["io.kubernetes.pod.namespace"]
+	metadata.PodName = info.Labels["io.kubernetes.pod.name"]
+	metadata.PodUID = info.Labels["io.kubernetes.pod.uid"]
+
+	return metadata, nil
+}
+
+func (c *containerdClient) Close() error {
+	return c.client.Close()
+}
+
+// genericCRIClient implements criClient over the CRI runtime gRPC API (used by CRI-O and other CRI-compliant
+// runtimes that don't expose a containerd-compatible client).
+type genericCRIClient struct {
+	conn *criGRPCConn
+}
+
+func newGenericCRIClient(socket string) (criClient, error) {
+	conn, err := dialCRIGRPC(socket)
+	if err != nil {
+		return nil, err
+	}
+	return &genericCRIClient{conn: conn}, nil
+}
+
+func (c *genericCRIClient) ContainerMetadata(ctx context.Context, containerID string) (*CRIMetadata, error) {
+	status, err := c.conn.ContainerStatus(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	podSandbox, err := c.conn.PodSandboxStatus(ctx, status.PodSandboxID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CRIMetadata{
+		ImageName:    status.Image,
+		ImageDigest:  status.ImageRef,
+		PodNamespace: podSandbox.Namespace,
+		PodName:      podSandbox.Name,
+		PodUID:       podSandbox.UID,
+		Labels:       status.Labels,
+		Annotations:  status.Annotations,
+	}, nil
+}
+
+func (c *genericCRIClient) Close() error {
+	return c.conn.Close()
+}
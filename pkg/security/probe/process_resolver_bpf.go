@@ -8,7 +8,11 @@
 package probe
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/pkg/errors"
@@ -19,6 +23,10 @@ import (
 	"github.com/DataDog/gopsutil/process"
 )
 
+// processResolverRunSubdir is the subdirectory of the agent's run directory the process resolver cache database
+// lives in.
+const processResolverRunSubdir = "runtime-security"
+
 // processSnapshotTables list of tables used to snapshot
 var processSnapshotTables = []string{
 	"inode_numlower",
@@ -39,22 +47,41 @@ type ProcessResolver struct {
 	inodeNumlowerMap *ebpf.Table
 	procCacheMap     *ebpf.Table
 	pidCookieMap     *ebpf.Table
-	entryCache       map[uint32]*ProcessResolverEntry
+	entryCache       *processEntryCache
+	store            *processResolverStore
+	liveKeys         *liveKeyTracker
+	snapshotBufferState
 }
 
 // AddEntry add an entry to the local cache
 func (p *ProcessResolver) AddEntry(pid uint32, entry *ProcessResolverEntry) {
-	p.entryCache[pid] = entry
+	p.entryCache.Add(pid, entry)
 }
 
-// DelEntry removes an entry from the cache
+// DelEntry removes a pid's in-kernel proc_cache and pid_cookie entries so that cookies don't leak for the
+// lifetime of the agent. It does NOT remove the pid from entryCache: an exited process may still be the ancestor
+// of a live one, and entryCache's own LRU + pinning policy is what decides when it's finally evicted.
 func (p *ProcessResolver) DelEntry(pid uint32) {
-	delete(p.entryCache, pid)
-
 	pidb := make([]byte, 4)
 	byteOrder.PutUint32(pidb, pid)
 
+	if cookieb, err := p.pidCookieMap.Get(pidb); err == nil {
+		p.procCacheMap.Delete(cookieb)
+	}
+
 	p.pidCookieMap.Delete(pidb)
+
+	if p.store != nil {
+		if key, ok := p.liveKeys.GetAndDelete(pid); ok {
+			p.store.Delete(key)
+		}
+	}
+}
+
+// Walk calls fn for every entry currently held in the cache. Used by the rule engine and the agent's status
+// command to enumerate the current process tree.
+func (p *ProcessResolver) Walk(fn func(pid uint32, entry *ProcessResolverEntry)) {
+	p.entryCache.Walk(fn)
 }
 
 func (p *ProcessResolver) resolve(pid uint32) *ProcessResolverEntry {
@@ -86,18 +113,22 @@ func (p *ProcessResolver) resolve(pid uint32) *ProcessResolverEntry {
 	entry := &ProcessResolverEntry{
 		PathnameStr: pathnameStr,
 		Timestamp:   timestamp,
+		PPid:        readProcPPid(pid),
 	}
 	p.AddEntry(pid, entry)
 
+	cacheKernelFallbacks.Add(1)
+
 	return entry
 }
 
 // Resolve returns the cache entry for the given pid
 func (p *ProcessResolver) Resolve(pid uint32) *ProcessResolverEntry {
-	entry, ok := p.entryCache[pid]
-	if ok {
+	if entry, ok := p.entryCache.Get(pid); ok {
+		cacheHits.Add(1)
 		return entry
 	}
+	cacheMisses.Add(1)
 
 	// fallback request the map directly, the perf event should be delayed
 	return p.resolve(pid)
@@ -117,36 +148,152 @@ func (p *ProcessResolver) Start() error {
 		return errors.New("pid_cookie BPF_HASH table doesn't exist")
 	}
 
+	if p.resolvers.CRIResolver == nil {
+		p.resolvers.CRIResolver = NewCRIResolver()
+	}
+
+	store, err := newProcessResolverStore(filepath.Join(p.probe.config.RunPath, processResolverRunSubdir))
+	if err != nil {
+		// The on-disk cache is a best-effort warm-up optimization, not a hard dependency: fall back to the
+		// current /proc-only behaviour rather than failing resolver startup.
+		log.Errorf("couldn't open process resolver cache database, warm-up cache disabled: %v", err)
+		return nil
+	}
+	p.store = store
+
 	return nil
 }
 
+// loadPersistedCache reloads entries written to disk by a previous run of the agent. Only entries whose pid is
+// still alive and whose /proc/<pid>/stat start_time still matches the persisted one are re-inserted: a stale entry
+// means the pid has been recycled since the agent stopped.
+func (p *ProcessResolver) loadPersistedCache() {
+	if p.store == nil {
+		return
+	}
+
+	records, err := p.store.LoadAll()
+	if err != nil {
+		log.Debugf("couldn't load persisted process resolver cache: %v", err)
+		return
+	}
+
+	for key, record := range records {
+		startTime, err := readProcStartTime(key.Pid)
+		if err != nil || startTime != key.StartTime {
+			p.store.Delete(key)
+			continue
+		}
+
+		p.AddEntry(key.Pid, &ProcessResolverEntry{
+			PathnameStr: record.PathnameStr,
+			Timestamp:   record.Timestamp,
+			PPid:        record.PPid,
+		})
+		p.liveKeys.Set(key.Pid, key)
+
+		if record.Cookie == 0 {
+			continue
+		}
+
+		entry := ProcCacheEntry{
+			Inode:           record.Inode,
+			OverlayNumLower: record.OverlayNumLower,
+		}
+		entry.ContainerEvent.ID = record.ContainerID
+
+		pidb := make([]byte, 4)
+		cookieb := make([]byte, 4)
+		byteOrder.PutUint32(pidb, key.Pid)
+		byteOrder.PutUint32(cookieb, record.Cookie)
+
+		if err := p.procCacheMap.SetP(cookieb, entry.Bytes()); err != nil {
+			log.Debugf("couldn't restore proc_cache entry for pid %d: %v", key.Pid, err)
+			continue
+		}
+		if err := p.pidCookieMap.SetP(pidb, cookieb); err != nil {
+			log.Debugf("couldn't restore pid_cookie entry for pid %d: %v", key.Pid, err)
+		}
+	}
+}
+
+// readProcStat parses /proc/<pid>/stat and returns the fields the process resolver cares about: the parent pid
+// (field 4) and the start time (field 22, in clock ticks since boot, used to disambiguate a pid from a previous
+// process that held the same pid).
+func readProcStat(pid uint32) (ppid uint32, startTime uint64, err error) {
+	data, err := os.ReadFile(filepath.Join(utils.ProcPath(pid), "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return parseProcStat(data)
+}
+
+// parseProcStat is the parsing half of readProcStat, split out so it can be exercised directly in tests with a
+// fixture instead of a real /proc/<pid>/stat file.
+func parseProcStat(data []byte) (ppid uint32, startTime uint64, err error) {
+	// the process name can itself contain spaces and parentheses, so start looking for fields after the last ')'
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 || end+2 >= len(data) {
+		return 0, 0, errors.New("malformed /proc/<pid>/stat")
+	}
+
+	fields := strings.Fields(string(data[end+2:]))
+	const (
+		ppidFieldIndex      = 1
+		startTimeFieldIndex = 19
+	)
+	if len(fields) <= startTimeFieldIndex {
+		return 0, 0, errors.New("malformed /proc/<pid>/stat: missing field")
+	}
+
+	ppid64, err := strconv.ParseUint(fields[ppidFieldIndex], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	startTime, err = strconv.ParseUint(fields[startTimeFieldIndex], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint32(ppid64), startTime, nil
+}
+
+// readProcStartTime is a convenience wrapper around readProcStat for callers that only need the start time.
+func readProcStartTime(pid uint32) (uint64, error) {
+	_, startTime, err := readProcStat(pid)
+	return startTime, err
+}
+
+// readProcPPid is a convenience wrapper around readProcStat for callers that only need the parent pid. It returns
+// 0 (no parent) if /proc/<pid>/stat can no longer be read.
+func readProcPPid(pid uint32) uint32 {
+	ppid, _, err := readProcStat(pid)
+	if err != nil {
+		return 0
+	}
+	return ppid
+}
+
 func (p *ProcessResolver) snapshot() error {
 	processes, err := process.AllProcesses()
 	if err != nil {
 		return err
 	}
 
-	cacheModified := false
-
 	for _, proc := range processes {
 		// If Exe is not set, the process is a short lived process and its /proc entry has already expired, move on.
 		if len(proc.Exe) == 0 {
 			continue
 		}
 
-		// Notify that we modified the cache.
-		if p.snapshotProcess(uint32(proc.Pid)) {
-			cacheModified = true
-		}
-	}
-
-	// There is a possible race condition where a process could have started right after we did the call to
-	// process.AllProcesses and before we inserted the cache entry of its parent. Call Snapshot again until we
-	// do not modify the process cache anymore
-	if cacheModified {
-		return errors.New("cache modified")
+		p.snapshotProcess(uint32(proc.Pid))
 	}
 
+	// A process that forked or exec'd right after process.AllProcesses() but before we inserted its parent's
+	// cache entry is no longer a race to retry for: the fork/exec tracepoint event for it is sitting in the
+	// snapshot buffer and will be folded in by drainSnapshotBuffer() once this walk returns.
 	return nil
 }
 
@@ -180,6 +327,20 @@ func (p *ProcessResolver) snapshotProcess(pid uint32) bool {
 	}
 	entry.ContainerEvent.ID = string(containerID)
 
+	// Best-effort CRI enrichment: a failure here (no runtime socket, unknown container, runtime error) must not
+	// fail the snapshot, it just means the rule engine won't see image/pod metadata for this process.
+	if p.resolvers.CRIResolver != nil {
+		if metadata, err := p.resolvers.CRIResolver.Resolve(entry.ContainerEvent.ID); err == nil {
+			entry.ContainerEvent.ImageName = metadata.ImageName
+			entry.ContainerEvent.ImageDigest = metadata.ImageDigest
+			entry.ContainerEvent.PodNamespace = metadata.PodNamespace
+			entry.ContainerEvent.PodName = metadata.PodName
+			entry.ContainerEvent.PodUID = metadata.PodUID
+			entry.ContainerEvent.Labels = metadata.Labels
+			entry.ContainerEvent.Annotations = metadata.Annotations
+		}
+	}
+
 	procExecPath := utils.ProcExePath(pid)
 
 	// Get process filename and pre-fill the cache
@@ -190,6 +351,7 @@ func (p *ProcessResolver) snapshotProcess(pid uint32) bool {
 	}
 	p.AddEntry(pid, &ProcessResolverEntry{
 		PathnameStr: pathnameStr,
+		PPid:        readProcPPid(pid),
 	})
 
 	// Get the inode of the process binary
@@ -227,6 +389,24 @@ func (p *ProcessResolver) snapshotProcess(pid uint32) bool {
 		return false
 	}
 
+	if ppid, startTime, err := readProcStat(pid); err == nil && p.store != nil {
+		key := pidStartTimeKey{Pid: pid, StartTime: startTime}
+		// liveKeys is only populated when there's a store to reconcile against: DelEntry only prunes it when
+		// p.store != nil, so setting it unconditionally would leak an entry per pid for the lifetime of the agent
+		// whenever the on-disk cache is disabled.
+		p.liveKeys.Set(pid, key)
+
+		p.store.Put(key, &processResolverRecord{
+			PathnameStr:     pathnameStr,
+			ContainerID:     entry.ContainerEvent.ID,
+			Inode:           entry.Inode,
+			OverlayNumLower: entry.OverlayNumLower,
+			Cookie:          byteOrder.Uint32(cookieb),
+			StartTime:       startTime,
+			PPid:            ppid,
+		})
+	}
+
 	return true
 }
 
@@ -252,7 +432,12 @@ func (p *ProcessResolver) Snapshot() error {
 		}
 	}
 
-	// Deregister probes
+	// Reload any entries persisted by a previous run of the agent before walking /proc, so that Resolve() can
+	// return valid data for processes that exit during this warm-up window.
+	p.loadPersistedCache()
+
+	// Deregister the snapshot-only probes once we're done; unlike processLifecycleProbes below, these are only
+	// needed to resolve the numlower value of a binary's inode during the /proc walk.
 	defer func() {
 		for _, kp := range processSnapshotProbes {
 			if err := p.probe.Module.UnregisterKprobe(kp); err != nil {
@@ -261,20 +446,47 @@ func (p *ProcessResolver) Snapshot() error {
 		}
 	}()
 
-	for retry := 0; retry < 5; retry++ {
-		if err := p.snapshot(); err == nil {
-			return nil
+	// Attach the fork/exec/exit tracepoints and start buffering the events they generate before walking /proc:
+	// a process that forks while we're mid-walk is then folded in by draining the buffer afterwards, instead of
+	// re-walking all of /proc from scratch until nothing changes.
+	if err := p.registerProcessLifecycleProbes(); err != nil {
+		return err
+	}
+	p.beginSnapshotBuffering()
+
+	err := p.snapshot()
+
+	p.drainSnapshotBuffer()
+
+	return err
+}
+
+// Close closes the CRI resolver's runtime client, if any, then flushes any pending writes to the on-disk cache and
+// closes it. The on-disk cache step is skipped if the disk cache failed to open or was never started.
+func (p *ProcessResolver) Close() error {
+	if p.resolvers.CRIResolver != nil {
+		if err := p.resolvers.CRIResolver.Close(); err != nil {
+			log.Debugf("couldn't close CRI resolver: %v", err)
 		}
 	}
 
-	return errors.New("unable to snapshot processes")
+	if p.store == nil {
+		return nil
+	}
+	return p.store.Close()
 }
 
 // NewProcessResolver returns a new process resolver
 func NewProcessResolver(probe *Probe, resolvers *Resolvers) (*ProcessResolver, error) {
+	cacheSize := probe.config.EntryCacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultEntryCacheSize
+	}
+
 	return &ProcessResolver{
 		probe:      probe,
 		resolvers:  resolvers,
-		entryCache: make(map[uint32]*ProcessResolverEntry),
+		entryCache: newProcessEntryCache(cacheSize),
+		liveKeys:   newLiveKeyTracker(),
 	}, nil
 }
@@ -0,0 +1,70 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// +build linux_bpf
+
+package probe
+
+import "testing"
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		name          string
+		stat          string
+		wantPPid      uint32
+		wantStartTime uint64
+		wantErr       bool
+	}{
+		{
+			name:          "simple comm",
+			stat:          "1234 (bash) S 1 1234 1234 0 -1 4194304 100 0 0 0 0 0 0 0 20 0 1 0 56789 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0",
+			wantPPid:      1,
+			wantStartTime: 56789,
+		},
+		{
+			name:          "comm contains spaces and parens",
+			stat:          "4321 (my (weird) process name) S 42 4321 4321 0 -1 4194304 100 0 0 0 0 0 0 0 20 0 1 0 99999 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0",
+			wantPPid:      42,
+			wantStartTime: 99999,
+		},
+		{
+			name:    "missing closing paren",
+			stat:    "1234 (bash S 1 1234",
+			wantErr: true,
+		},
+		{
+			name:    "truncated after comm",
+			stat:    "1234 (bash)",
+			wantErr: true,
+		},
+		{
+			name:    "too few fields for start_time",
+			stat:    "1234 (bash) S 1 1234 1234",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ppid, startTime, err := parseProcStat([]byte(tt.stat))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got ppid=%d startTime=%d", ppid, startTime)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ppid != tt.wantPPid {
+				t.Errorf("ppid = %d, want %d", ppid, tt.wantPPid)
+			}
+			if startTime != tt.wantStartTime {
+				t.Errorf("startTime = %d, want %d", startTime, tt.wantStartTime)
+			}
+		})
+	}
+}
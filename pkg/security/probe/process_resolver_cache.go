@@ -0,0 +1,202 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// +build linux_bpf
+
+package probe
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+)
+
+// defaultEntryCacheSize bounds how many pid entries are held in memory at once, so that hosts with heavy process
+// churn (build servers, CI runners) don't grow entryCache without bound.
+const defaultEntryCacheSize = 16384
+
+// processResolverCacheStats exposes the process resolver cache counters over expvar, so they show up in the
+// agent's status command and can be scraped alongside the rest of the runtime security metrics.
+var processResolverCacheStats = expvar.NewMap("runtime_security.process_resolver.cache")
+
+var (
+	cacheHits            = new(expvar.Int)
+	cacheMisses          = new(expvar.Int)
+	cacheEvictions       = new(expvar.Int)
+	cacheKernelFallbacks = new(expvar.Int)
+)
+
+func init() {
+	processResolverCacheStats.Set("hits", cacheHits)
+	processResolverCacheStats.Set("misses", cacheMisses)
+	processResolverCacheStats.Set("evictions", cacheEvictions)
+	processResolverCacheStats.Set("kernel_fallbacks", cacheKernelFallbacks)
+}
+
+// processCacheNode is the value held by each entry in the LRU list.
+type processCacheNode struct {
+	pid   uint32
+	entry *ProcessResolverEntry
+}
+
+// processEntryCache is a size-bounded LRU cache of pid -> *ProcessResolverEntry that additionally pins any entry
+// that is the ancestor of another entry currently held in the cache, so that ancestor lookups used by rule
+// evaluation don't miss just because the ancestor itself aged out of LRU order.
+type processEntryCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[uint32]*list.Element
+
+	// children maps a pid to the set of pids currently in the cache whose PPid is that pid. A pid with at least
+	// one entry here is pinned: it's an ancestor of something still in the cache and evicting it would break
+	// ancestor lookups for that something's whole lineage. Recorded independently of whether the pid itself is
+	// cached yet, so pinning holds regardless of the order entries are added in (the /proc walk that populates
+	// the cache on startup visits pids in arbitrary order, so a child can easily be added before its parent).
+	children map[uint32]map[uint32]struct{}
+}
+
+func newProcessEntryCache(capacity int) *processEntryCache {
+	if capacity <= 0 {
+		capacity = defaultEntryCacheSize
+	}
+
+	return &processEntryCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[uint32]*list.Element),
+		children: make(map[uint32]map[uint32]struct{}),
+	}
+}
+
+func (c *processEntryCache) addChild(ppid, pid uint32) {
+	if ppid == 0 {
+		return
+	}
+
+	set, ok := c.children[ppid]
+	if !ok {
+		set = make(map[uint32]struct{})
+		c.children[ppid] = set
+	}
+	set[pid] = struct{}{}
+}
+
+func (c *processEntryCache) removeChild(ppid, pid uint32) {
+	set, ok := c.children[ppid]
+	if !ok {
+		return
+	}
+
+	delete(set, pid)
+	if len(set) == 0 {
+		delete(c.children, ppid)
+	}
+}
+
+// isPinned reports whether pid has at least one child currently in the cache.
+func (c *processEntryCache) isPinned(pid uint32) bool {
+	return len(c.children[pid]) > 0
+}
+
+// Add inserts or updates the entry for pid, evicting the least-recently-used unpinned entry if the cache is over
+// capacity.
+func (c *processEntryCache) Add(pid uint32, entry *ProcessResolverEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[pid]; ok {
+		node := elem.Value.(*processCacheNode)
+		if node.entry.PPid != entry.PPid {
+			c.removeChild(node.entry.PPid, pid)
+			c.addChild(entry.PPid, pid)
+		}
+		node.entry = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	node := &processCacheNode{pid: pid, entry: entry}
+	elem := c.ll.PushFront(node)
+	c.items[pid] = elem
+	c.addChild(entry.PPid, pid)
+
+	for c.ll.Len() > c.capacity {
+		if !c.evictOldest() {
+			// every remaining entry is pinned by a live descendant: let the cache temporarily grow past
+			// capacity rather than evict data ancestor lookups still need.
+			break
+		}
+	}
+}
+
+// evictOldest removes the least-recently-used entry that isn't pinned. It returns false if no entry could be
+// evicted (every entry is currently pinned).
+func (c *processEntryCache) evictOldest() bool {
+	for elem := c.ll.Back(); elem != nil; elem = elem.Prev() {
+		node := elem.Value.(*processCacheNode)
+		if c.isPinned(node.pid) {
+			continue
+		}
+
+		c.ll.Remove(elem)
+		delete(c.items, node.pid)
+		c.removeChild(node.entry.PPid, node.pid)
+		cacheEvictions.Add(1)
+		return true
+	}
+
+	return false
+}
+
+// Get returns the cached entry for pid, promoting it to most-recently-used.
+func (c *processEntryCache) Get(pid uint32) (*ProcessResolverEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[pid]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*processCacheNode).entry, true
+}
+
+// Remove evicts pid immediately, regardless of LRU order. Used when a pid's cached entry is known to be stale (e.g.
+// after an exec event that carried no cookie) rather than just aged out.
+func (c *processEntryCache) Remove(pid uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[pid]
+	if !ok {
+		return
+	}
+
+	node := elem.Value.(*processCacheNode)
+	c.ll.Remove(elem)
+	delete(c.items, pid)
+	c.removeChild(node.entry.PPid, pid)
+}
+
+// Len returns the number of entries currently cached.
+func (c *processEntryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Walk calls fn for every entry currently cached, most-recently-used first. Used by the rule engine and the
+// agent's status command to enumerate the current process tree.
+func (c *processEntryCache) Walk(fn func(pid uint32, entry *ProcessResolverEntry)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.ll.Front(); elem != nil; elem = elem.Next() {
+		node := elem.Value.(*processCacheNode)
+		fn(node.pid, node.entry)
+	}
+}
@@ -0,0 +1,222 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// +build linux_bpf
+
+package probe
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/DataDog/datadog-agent/pkg/security/ebpf"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+// processLifecycleEventsPerfMap is the perf event array the sched_process_* tracepoints push events to.
+const processLifecycleEventsPerfMap = "process_events"
+
+// processLifecycleBufferCapacity bounds how many events are buffered while the initial /proc snapshot is in
+// progress, so a fork storm during startup can't grow memory unbounded. This is a capacity-bounded FIFO slice,
+// not a fixed-size ring buffer: once full, handleProcessLifecycleEvent drops one buffered event to make room
+// before appending the new one.
+const processLifecycleBufferCapacity = 4096
+
+// processLifecycleProbes are the tracepoints that replace the old poll-and-retry snapshot loop: instead of
+// re-walking /proc until nothing changes, fork/exec/exit events are pushed to userspace as they happen and
+// AddEntry/DelEntry are driven directly from them.
+var processLifecycleProbes = []*ebpf.KProbe{
+	{
+		Name:      "sched_process_fork",
+		EntryFunc: "tracepoint/sched/sched_process_fork",
+	},
+	{
+		Name:      "sched_process_exec",
+		EntryFunc: "tracepoint/sched/sched_process_exec",
+	},
+	{
+		Name:      "sched_process_exit",
+		EntryFunc: "tracepoint/sched/sched_process_exit",
+	},
+}
+
+const (
+	processLifecycleEventFork uint32 = iota
+	processLifecycleEventExec
+	processLifecycleEventExit
+)
+
+// processLifecycleEvent is the fixed-size record pushed by the sched_process_* tracepoints: type (4 bytes), pid (4
+// bytes), ppid (4 bytes), cookie (4 bytes, zero for fork/exit).
+type processLifecycleEvent struct {
+	Type   uint32
+	Pid    uint32
+	PPid   uint32
+	Cookie uint32
+}
+
+func parseProcessLifecycleEvent(data []byte) (*processLifecycleEvent, error) {
+	if len(data) < 16 {
+		return nil, errors.New("process lifecycle event too short")
+	}
+
+	return &processLifecycleEvent{
+		Type:   byteOrder.Uint32(data[0:4]),
+		Pid:    byteOrder.Uint32(data[4:8]),
+		PPid:   byteOrder.Uint32(data[8:12]),
+		Cookie: byteOrder.Uint32(data[12:16]),
+	}, nil
+}
+
+// registerProcessLifecycleProbes attaches the fork/exec/exit tracepoints and starts routing the perf events they
+// generate to p.handleProcessLifecycleEvent. Unlike the inode_numlower snapshot probes, these stay registered for
+// the lifetime of the resolver: ongoing cache maintenance depends on them, not just the initial snapshot.
+func (p *ProcessResolver) registerProcessLifecycleProbes() error {
+	for _, kp := range processLifecycleProbes {
+		if err := p.probe.Module.RegisterKprobe(kp); err != nil {
+			return errors.Wrapf(err, "couldn't register tracepoint %s", kp.Name)
+		}
+	}
+
+	if err := p.probe.Module.RegisterPerfMap(processLifecycleEventsPerfMap, p.handleProcessLifecycleEvent); err != nil {
+		return errors.Wrap(err, "couldn't register process lifecycle perf map")
+	}
+
+	return nil
+}
+
+// handleProcessLifecycleEvent is invoked for every event read off the process_events perf map. While a snapshot is
+// in progress, events are buffered instead of applied immediately so that a fork racing the /proc walk is folded
+// in afterwards rather than interleaved with it.
+func (p *ProcessResolver) handleProcessLifecycleEvent(data []byte) {
+	event, err := parseProcessLifecycleEvent(data)
+	if err != nil {
+		log.Debugf("couldn't parse process lifecycle event: %v", err)
+		return
+	}
+
+	p.snapshotBufferLock.Lock()
+	if p.snapshotBuffer != nil {
+		if len(p.snapshotBuffer) >= processLifecycleBufferCapacity {
+			// drop the oldest non-exit event to make room: exit events matter more than fork/exec events for
+			// correctness (losing one leaks a cookie forever, losing a fork/exec just means a slightly stale
+			// cache entry until the next event for that pid). Only if every buffered event is itself an exit do
+			// we fall back to dropping the oldest one outright, since there's nothing better left to sacrifice.
+			dropIdx := 0
+			for i, buffered := range p.snapshotBuffer {
+				if buffered.Type != processLifecycleEventExit {
+					dropIdx = i
+					break
+				}
+			}
+			p.snapshotBuffer = append(p.snapshotBuffer[:dropIdx], p.snapshotBuffer[dropIdx+1:]...)
+		}
+		p.snapshotBuffer = append(p.snapshotBuffer, event)
+		p.snapshotBufferLock.Unlock()
+		return
+	}
+	p.snapshotBufferLock.Unlock()
+
+	p.applyProcessLifecycleEvent(event)
+}
+
+// applyProcessLifecycleEvent folds a single fork/exec/exit event into entryCache and the in-kernel maps.
+func (p *ProcessResolver) applyProcessLifecycleEvent(event *processLifecycleEvent) {
+	switch event.Type {
+	case processLifecycleEventFork:
+		// snapshotProcess is idempotent (it bails out early if pidCookieMap already has an entry for the pid), so
+		// reuse it here rather than duplicating the /proc read + cache insert logic.
+		p.snapshotProcess(event.Pid)
+	case processLifecycleEventExec:
+		// An exec reuses the pid of an already-forked process, so pidCookieMap already has an entry for it and
+		// snapshotProcess would bail out immediately, leaving entryCache pointing at the pre-exec binary forever.
+		// The event's cookie is the new one the kernel already installed for this pid, so refresh entryCache
+		// directly from it instead.
+		p.refreshEntryAfterExec(event)
+	case processLifecycleEventExit:
+		p.DelEntry(event.Pid)
+	}
+}
+
+// refreshEntryAfterExec re-resolves entryCache's entry for event.Pid using the proc_cache entry the kernel already
+// installed under event.Cookie.
+func (p *ProcessResolver) refreshEntryAfterExec(event *processLifecycleEvent) {
+	if event.Cookie == 0 {
+		log.Debugf("exec event for pid %d carried no cookie, falling back to a fresh snapshot", event.Pid)
+		p.entryCache.Remove(event.Pid)
+		p.snapshotProcess(event.Pid)
+		return
+	}
+
+	cookieb := make([]byte, 4)
+	byteOrder.PutUint32(cookieb, event.Cookie)
+
+	entryb, err := p.procCacheMap.Get(cookieb)
+	if err != nil {
+		log.Debugf("couldn't refresh entry for pid %d after exec: %v", event.Pid, err)
+		return
+	}
+
+	var procCacheEntry ProcCacheEntry
+	if _, err := procCacheEntry.UnmarshalBinary(entryb); err != nil {
+		log.Debugf("couldn't decode proc_cache entry for pid %d after exec: %v", event.Pid, err)
+		return
+	}
+
+	pathnameStr := procCacheEntry.FileEvent.ResolveInode(p.resolvers)
+	if pathnameStr == dentryPathKeyNotFound {
+		return
+	}
+
+	timestamp := p.resolvers.TimeResolver.ResolveMonotonicTimestamp(procCacheEntry.TimestampRaw)
+
+	p.AddEntry(event.Pid, &ProcessResolverEntry{
+		PathnameStr: pathnameStr,
+		Timestamp:   timestamp,
+		PPid:        event.PPid,
+	})
+}
+
+// beginSnapshotBuffering starts buffering fork/exec/exit events instead of applying them immediately. Call before
+// walking /proc so that races between the walk and a concurrent fork are resolved by draining the buffer
+// afterwards instead of by retrying the whole walk.
+func (p *ProcessResolver) beginSnapshotBuffering() {
+	p.snapshotBufferLock.Lock()
+	p.snapshotBuffer = make([]*processLifecycleEvent, 0, processLifecycleBufferCapacity)
+	p.snapshotBufferLock.Unlock()
+}
+
+// drainSnapshotBuffer applies every event buffered since beginSnapshotBuffering, in order, then switches back to
+// applying future events immediately. Applying an event happens without snapshotBufferLock held, so a new event
+// arriving on handleProcessLifecycleEvent's goroutine while a batch is being applied must keep landing in the
+// buffer rather than taking the immediate-apply path: otherwise a live exit could race ahead of a still-buffered
+// fork/exec for the same pid and re-leak its cookie. So snapshotBuffer is only swapped back to nil once a pass
+// over it, taken and checked under the same lock acquisition, finds it empty; any event appended during a pass
+// is picked up by the next one.
+func (p *ProcessResolver) drainSnapshotBuffer() {
+	for {
+		p.snapshotBufferLock.Lock()
+		if len(p.snapshotBuffer) == 0 {
+			p.snapshotBuffer = nil
+			p.snapshotBufferLock.Unlock()
+			return
+		}
+		buffered := p.snapshotBuffer
+		p.snapshotBuffer = make([]*processLifecycleEvent, 0, processLifecycleBufferCapacity)
+		p.snapshotBufferLock.Unlock()
+
+		for _, event := range buffered {
+			p.applyProcessLifecycleEvent(event)
+		}
+	}
+}
+
+// snapshotBufferState holds the capacity-bounded event buffer used while an initial snapshot is in progress. It
+// is embedded directly in ProcessResolver (see process_resolver_bpf.go).
+type snapshotBufferState struct {
+	snapshotBufferLock sync.Mutex
+	snapshotBuffer     []*processLifecycleEvent
+}
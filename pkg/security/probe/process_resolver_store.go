@@ -0,0 +1,260 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// +build linux_bpf
+
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+)
+
+const (
+	// processResolverDBFilename is the name of the bbolt database file used to persist the process resolver cache
+	// across agent restarts.
+	processResolverDBFilename = "process-resolver.db"
+
+	// pidEntriesBucket stores gob-encoded processResolverRecord values keyed by pidStartTimeKey(pid, startTime).
+	pidEntriesBucket = "pid_entries"
+
+	// defaultCacheFlushInterval is how often dirty entries are batched and written to disk.
+	defaultCacheFlushInterval = 2 * time.Second
+)
+
+// processResolverRecord is the on-disk representation of a ProcessResolverEntry. It is intentionally decoupled from
+// ProcessResolverEntry so that the wire format can evolve independently of the in-memory struct.
+type processResolverRecord struct {
+	PathnameStr     string
+	Timestamp       time.Time
+	ContainerID     string
+	Inode           uint64
+	OverlayNumLower int32
+	Cookie          uint32
+	StartTime       uint64
+	PPid            uint32
+}
+
+// processResolverStore persists ProcessResolverEntry objects to a bbolt database so that the cache can survive an
+// agent restart. Writes are batched and flushed asynchronously to bound write amplification.
+type processResolverStore struct {
+	db            *bolt.DB
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	dirty   map[pidStartTimeKey]*processResolverRecord
+	deleted map[pidStartTimeKey]struct{}
+
+	stopper chan struct{}
+	stopped chan struct{}
+}
+
+// pidStartTimeKey uniquely identifies a process across pid reuse by pairing the pid with its /proc start_time.
+type pidStartTimeKey struct {
+	Pid       uint32
+	StartTime uint64
+}
+
+func (k pidStartTimeKey) Bytes() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:4], k.Pid)
+	binary.BigEndian.PutUint64(b[4:12], k.StartTime)
+	return b
+}
+
+// liveKeyTracker records, for each pid currently believed live, the pidStartTimeKey it was last persisted under,
+// so that an exit event can purge the right record from the on-disk cache. It's written from both the /proc
+// snapshot walk and the fork/exec/exit perf event handlers, which can run concurrently, so access is guarded by
+// its own mutex rather than relying on single-goroutine access.
+type liveKeyTracker struct {
+	mu   sync.Mutex
+	keys map[uint32]pidStartTimeKey
+}
+
+func newLiveKeyTracker() *liveKeyTracker {
+	return &liveKeyTracker{keys: make(map[uint32]pidStartTimeKey)}
+}
+
+// Set records the pidStartTimeKey a pid was last persisted under.
+func (t *liveKeyTracker) Set(pid uint32, key pidStartTimeKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[pid] = key
+}
+
+// GetAndDelete returns and forgets the pidStartTimeKey recorded for pid, if any.
+func (t *liveKeyTracker) GetAndDelete(pid uint32) (pidStartTimeKey, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key, ok := t.keys[pid]
+	if ok {
+		delete(t.keys, pid)
+	}
+	return key, ok
+}
+
+// newProcessResolverStore opens (or creates) the bbolt database at runPath/processResolverDBFilename and ensures
+// its bucket exists.
+func newProcessResolverStore(runPath string) (*processResolverStore, error) {
+	if err := os.MkdirAll(runPath, 0750); err != nil {
+		return nil, errors.Wrap(err, "couldn't create process resolver run directory")
+	}
+
+	db, err := bolt.Open(filepath.Join(runPath, processResolverDBFilename), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't open process resolver cache database")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(pidEntriesBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "couldn't initialize process resolver cache bucket")
+	}
+
+	store := &processResolverStore{
+		db:            db,
+		flushInterval: defaultCacheFlushInterval,
+		dirty:         make(map[pidStartTimeKey]*processResolverRecord),
+		deleted:       make(map[pidStartTimeKey]struct{}),
+		stopper:       make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	go store.flushLoop()
+
+	return store, nil
+}
+
+// Put queues a record for the next batched flush.
+func (s *processResolverStore) Put(key pidStartTimeKey, record *processResolverRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deleted, key)
+	s.dirty[key] = record
+}
+
+// Delete queues the removal of a record for the next batched flush.
+func (s *processResolverStore) Delete(key pidStartTimeKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.dirty, key)
+	s.deleted[key] = struct{}{}
+}
+
+func (s *processResolverStore) flushLoop() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				log.Debugf("process resolver cache flush failed: %v", err)
+			}
+		case <-s.stopper:
+			if err := s.flush(); err != nil {
+				log.Debugf("process resolver cache final flush failed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (s *processResolverStore) flush() error {
+	s.mu.Lock()
+	if len(s.dirty) == 0 && len(s.deleted) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	dirty := s.dirty
+	deleted := s.deleted
+	s.dirty = make(map[pidStartTimeKey]*processResolverRecord)
+	s.deleted = make(map[pidStartTimeKey]struct{})
+	s.mu.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pidBucket := tx.Bucket([]byte(pidEntriesBucket))
+
+		for key, record := range dirty {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+				return errors.Wrapf(err, "couldn't encode process resolver record for pid %d", key.Pid)
+			}
+			if err := pidBucket.Put(key.Bytes(), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		for key := range deleted {
+			if err := pidBucket.Delete(key.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// LoadAll reads every persisted record out of the pid_entries bucket.
+func (s *processResolverStore) LoadAll() (map[pidStartTimeKey]*processResolverRecord, error) {
+	entries := make(map[pidStartTimeKey]*processResolverRecord)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pidEntriesBucket))
+		return bucket.ForEach(func(k, v []byte) error {
+			if len(k) != 12 {
+				return fmt.Errorf("unexpected pid entry key length %d", len(k))
+			}
+
+			key := pidStartTimeKey{
+				Pid:       binary.BigEndian.Uint32(k[0:4]),
+				StartTime: binary.BigEndian.Uint64(k[4:12]),
+			}
+
+			var record processResolverRecord
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&record); err != nil {
+				log.Debugf("couldn't decode process resolver record for pid %d: %v", key.Pid, err)
+				return nil
+			}
+
+			entries[key] = &record
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't load process resolver cache")
+	}
+
+	return entries, nil
+}
+
+// Close stops the flush loop, flushes any remaining dirty entries and fsyncs the database before closing it.
+func (s *processResolverStore) Close() error {
+	close(s.stopper)
+	<-s.stopped
+
+	if err := s.db.Sync(); err != nil {
+		log.Debugf("couldn't fsync process resolver cache database: %v", err)
+	}
+
+	return s.db.Close()
+}
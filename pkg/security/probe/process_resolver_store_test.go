@@ -0,0 +1,82 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2016-2020 Datadog, Inc.
+
+// +build linux_bpf
+
+package probe
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPidStartTimeKeyBytesRoundTrip(t *testing.T) {
+	key := pidStartTimeKey{Pid: 4242, StartTime: 1234567890123}
+	b := key.Bytes()
+
+	if len(b) != 12 {
+		t.Fatalf("expected a 12-byte key, got %d bytes", len(b))
+	}
+	if got := binary.BigEndian.Uint32(b[0:4]); got != key.Pid {
+		t.Errorf("decoded pid = %d, want %d", got, key.Pid)
+	}
+	if got := binary.BigEndian.Uint64(b[4:12]); got != key.StartTime {
+		t.Errorf("decoded start time = %d, want %d", got, key.StartTime)
+	}
+}
+
+func TestProcessResolverStorePutLoadDelete(t *testing.T) {
+	store, err := newProcessResolverStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newProcessResolverStore: %v", err)
+	}
+	defer store.Close()
+
+	key := pidStartTimeKey{Pid: 99, StartTime: 555}
+	record := &processResolverRecord{
+		PathnameStr:     "/usr/bin/example",
+		Timestamp:       time.Unix(1700000000, 0).UTC(),
+		ContainerID:     "abcd1234",
+		Inode:           123456,
+		OverlayNumLower: 2,
+		Cookie:          0xcafef00d,
+		StartTime:       key.StartTime,
+		PPid:            1,
+	}
+
+	store.Put(key, record)
+	if err := store.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	loaded, err := store.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll: %v", err)
+	}
+
+	got, ok := loaded[key]
+	if !ok {
+		t.Fatalf("expected key %+v to be present after flush, got %+v", key, loaded)
+	}
+	if got.PathnameStr != record.PathnameStr || got.ContainerID != record.ContainerID ||
+		got.Inode != record.Inode || got.OverlayNumLower != record.OverlayNumLower ||
+		got.Cookie != record.Cookie || got.PPid != record.PPid || !got.Timestamp.Equal(record.Timestamp) {
+		t.Errorf("round-tripped record = %+v, want %+v", got, record)
+	}
+
+	store.Delete(key)
+	if err := store.flush(); err != nil {
+		t.Fatalf("flush after delete: %v", err)
+	}
+
+	loaded, err = store.LoadAll()
+	if err != nil {
+		t.Fatalf("LoadAll after delete: %v", err)
+	}
+	if _, ok := loaded[key]; ok {
+		t.Errorf("expected key %+v to be gone after Delete+flush", key)
+	}
+}